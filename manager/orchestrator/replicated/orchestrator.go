@@ -0,0 +1,392 @@
+package replicated
+
+import (
+	"time"
+
+	"github.com/docker/go-events"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/orchestrator"
+	"github.com/docker/swarmkit/manager/orchestrator/restart"
+	"github.com/docker/swarmkit/manager/state"
+	"github.com/docker/swarmkit/manager/state/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// restartBudgetExceededMessage is surfaced on a deferred replacement
+// task's Status.Message so operators can see why it hasn't progressed to
+// Running.
+const restartBudgetExceededMessage = "restart budget exceeded"
+
+// restartBudgetRetryInterval is how often a task deferred by a
+// RestartBudget is re-checked against the budget.
+const restartBudgetRetryInterval = 5 * time.Second
+
+// Orchestrator runs a reconciliation loop that keeps the number of running
+// tasks for every replicated service equal to its desired replica count,
+// creating tasks for missing slots and restarting tasks as services and
+// their tasks change. It does not remove tasks when a service is scaled
+// down or deleted.
+type Orchestrator struct {
+	store *store.MemoryStore
+
+	// restarts manages the restart history and delayed-start logic for
+	// every task.
+	restarts *restart.RestartSupervisor
+
+	cluster *api.Cluster
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewReplicatedOrchestrator creates a new replicated Orchestrator backed by
+// the given store. Restart/backoff metrics are registered on reg, which may
+// be nil to register on prometheus.DefaultRegisterer.
+func NewReplicatedOrchestrator(s *store.MemoryStore, reg prometheus.Registerer) *Orchestrator {
+	return &Orchestrator{
+		store:    s,
+		restarts: restart.NewRestartSupervisor(s, restart.NewMetrics(reg)),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+}
+
+// Run contains the orchestrator's reconciliation loop. It creates tasks for
+// any services that exist at startup, then reacts to relevant store events
+// until Stop is called or the context is cancelled.
+func (r *Orchestrator) Run(ctx context.Context) error {
+	defer close(r.doneChan)
+
+	watch, cancel := state.Watch(
+		r.store.WatchQueue(),
+		api.EventCreateService{},
+		api.EventUpdateService{},
+		api.EventDeleteService{},
+		api.EventCreateTask{},
+		api.EventUpdateTask{},
+		api.EventDeleteTask{},
+		api.EventCreateCluster{},
+		api.EventUpdateCluster{},
+	)
+	defer cancel()
+
+	var services []*api.Service
+	err := r.store.View(func(readTx store.ReadTx) error {
+		var err error
+		services, err = store.FindServices(readTx, store.All)
+		if err != nil {
+			return err
+		}
+		clusters, err := store.FindClusters(readTx, store.All)
+		if err != nil {
+			return err
+		}
+		if len(clusters) == 1 {
+			r.cluster = clusters[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		if orchestrator.IsReplicatedService(s) {
+			r.reconcileServiceID(ctx, s.ID)
+		}
+	}
+
+	for {
+		select {
+		case ev := <-watch:
+			r.handleEvent(ctx, ev)
+		case <-r.stopChan:
+			return nil
+		}
+	}
+}
+
+// Stop stops the orchestrator and waits for the run loop to exit.
+func (r *Orchestrator) Stop() {
+	select {
+	case <-r.stopChan:
+	default:
+		close(r.stopChan)
+	}
+	<-r.doneChan
+	r.restarts.CancelAll()
+}
+
+func (r *Orchestrator) handleEvent(ctx context.Context, ev events.Event) {
+	switch v := ev.(type) {
+	case api.EventCreateService:
+		if orchestrator.IsReplicatedService(v.Service) {
+			r.reconcileServiceID(ctx, v.Service.ID)
+		}
+	case api.EventUpdateService:
+		if orchestrator.IsReplicatedService(v.Service) {
+			r.reconcileServiceID(ctx, v.Service.ID)
+		}
+	case api.EventCreateTask:
+		r.handleTaskEvent(ctx, v.Task)
+	case api.EventUpdateTask:
+		r.handleTaskEvent(ctx, v.Task)
+	case api.EventCreateCluster:
+		r.cluster = v.Cluster
+	case api.EventUpdateCluster:
+		r.cluster = v.Cluster
+		// The cluster-wide default restart/backoff policy may have
+		// changed. Restart decisions resolve the service's policy
+		// against r.cluster when a task fails, so the new default
+		// applies from each tracked service's next failure on;
+		// re-running reconciliation creates any missing tasks with it.
+		r.reconcileAllServices(ctx)
+	}
+}
+
+// reconcileAllServices reconciles every replicated service currently in the
+// store, e.g. after a cluster-wide default changes.
+func (r *Orchestrator) reconcileAllServices(ctx context.Context) {
+	var services []*api.Service
+	err := r.store.View(func(tx store.ReadTx) error {
+		var err error
+		services, err = store.FindServices(tx, store.All)
+		return err
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list services for cluster-wide reconciliation")
+		return
+	}
+	for _, s := range services {
+		if orchestrator.IsReplicatedService(s) {
+			r.reconcileServiceID(ctx, s.ID)
+		}
+	}
+}
+
+// effectiveService returns service with its TaskSpec.Restart resolved
+// against the cluster's DefaultRestartPolicy/DefaultBackoffPolicy: a
+// service with no RestartPolicy inherits the cluster-wide default
+// entirely, and one with its own RestartPolicy inherits only the
+// delay/window/backoff it leaves unset (see mergeRestartPolicy).
+func (r *Orchestrator) effectiveService(service *api.Service) *api.Service {
+	if r.cluster == nil {
+		return service
+	}
+	merged := mergeRestartPolicy(r.cluster.Spec.DefaultRestartPolicy, r.cluster.Spec.DefaultBackoffPolicy, service.Spec.Task.Restart)
+	if merged == service.Spec.Task.Restart {
+		return service
+	}
+	clone := service.Copy()
+	clone.Spec.Task.Restart = merged
+	return clone
+}
+
+// mergeRestartPolicy overlays svc on top of defRestart/defBackoff. A nil svc
+// (the service's TaskSpec has no RestartPolicy at all) inherits
+// defRestart/defBackoff entirely, including Condition and MaxAttempts.
+//
+// A non-nil svc, however, is a service that has explicitly configured a
+// RestartPolicy, so its Condition and MaxAttempts are taken as-is and never
+// overridden by the cluster default: RESTART_ON_NONE and MaxAttempts == 0
+// are both meaningful, deliberately-set values (see their doc comments),
+// and there's no way to distinguish "service left this unset" from
+// "service explicitly chose the zero value" at this scalar-field level.
+// Delay/Window/Backoff don't have that ambiguity (nil unambiguously means
+// "not set"), so those still fall back to the cluster default field-by
+// field.
+func mergeRestartPolicy(defRestart *api.RestartPolicy, defBackoff *api.BackoffPolicy, svc *api.RestartPolicy) *api.RestartPolicy {
+	if defRestart == nil && defBackoff == nil {
+		return svc
+	}
+	if svc == nil {
+		if defRestart == nil {
+			return &api.RestartPolicy{Backoff: defBackoff}
+		}
+		merged := defRestart.Copy()
+		if merged.Backoff == nil {
+			merged.Backoff = defBackoff
+		}
+		return merged
+	}
+
+	merged := svc.Copy()
+	if defRestart != nil {
+		if merged.Delay == nil {
+			merged.Delay = defRestart.Delay
+		}
+		if merged.Window == nil {
+			merged.Window = defRestart.Window
+		}
+		if merged.Backoff == nil {
+			merged.Backoff = defRestart.Backoff
+		}
+	}
+	if merged.Backoff == nil {
+		merged.Backoff = defBackoff
+	}
+	return merged
+}
+
+// reconcileServiceID creates any missing task slots for the replicated
+// service with the given ID, up to its desired replica count.
+func (r *Orchestrator) reconcileServiceID(ctx context.Context, serviceID string) {
+	err := r.store.Update(func(tx store.Tx) error {
+		service := store.GetService(tx, serviceID)
+		if service == nil {
+			return nil
+		}
+		service = r.effectiveService(service)
+		replicas := service.Spec.GetReplicated().Replicas
+
+		runningSlots, err := store.FindTasks(tx, store.ByServiceID(serviceID))
+		if err != nil {
+			return err
+		}
+
+		existing := make(map[uint64]struct{})
+		for _, t := range runningSlots {
+			if t.DesiredState <= api.TaskStateRunning {
+				existing[t.Slot] = struct{}{}
+			}
+		}
+
+		for slot := uint64(1); slot <= replicas; slot++ {
+			if _, ok := existing[slot]; ok {
+				continue
+			}
+			task := orchestrator.NewTask(r.cluster, service, slot, "")
+			if err := store.CreateTask(tx, task); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", serviceID).Error("reconciliation failed")
+	}
+}
+
+// deferForBudget marks taskID's Status.Message to explain that it is being
+// held in TaskStateReady because its service's RestartBudget was
+// exhausted. Marking the task publishes an EventUpdateTask that brings it
+// back through handleTaskEvent; that call, finding the message already
+// set, schedules a retry restartBudgetRetryInterval later.
+func (r *Orchestrator) deferForBudget(ctx context.Context, taskID string) {
+	marked := false
+	err := r.store.Update(func(tx store.Tx) error {
+		task := store.GetTask(tx, taskID)
+		if task == nil || task.Status.Message == restartBudgetExceededMessage {
+			return nil
+		}
+		task.Status.Message = restartBudgetExceededMessage
+		if err := store.UpdateTask(tx, task); err != nil {
+			return err
+		}
+		marked = true
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", taskID).Error("failed to record restart budget deferral")
+	} else if marked {
+		return
+	}
+
+	time.AfterFunc(restartBudgetRetryInterval, func() {
+		select {
+		case <-r.stopChan:
+			return
+		default:
+		}
+
+		// Touch the task through a store update, rather than calling
+		// handleTaskEvent directly from this timer goroutine: the update
+		// publishes a normal EventUpdateTask, which is picked back up by
+		// Run's own goroutine, the only one allowed to read/write
+		// orchestrator state such as r.cluster.
+		err := r.store.Update(func(tx store.Tx) error {
+			task := store.GetTask(tx, taskID)
+			if task == nil || task.DesiredState != api.TaskStateReady || task.Status.State != api.TaskStateNew {
+				return nil
+			}
+			return store.UpdateTask(tx, task)
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("task.id", taskID).Error("failed to re-trigger restart budget retry")
+		}
+	})
+}
+
+// handleTaskEvent reacts to a task reaching a terminal state by invoking
+// the restart supervisor, and progresses freshly created replacement tasks
+// (DesiredState == TaskStateReady) to Running, honoring any restart delay.
+func (r *Orchestrator) handleTaskEvent(ctx context.Context, t *api.Task) {
+	if t.DesiredState == api.TaskStateReady && t.Status.State == api.TaskStateNew {
+		policy := restart.Policy(t)
+		var withinBudget bool
+		r.store.View(func(tx store.ReadTx) error {
+			withinBudget = r.restarts.WithinRestartBudget(tx, policy, t.ServiceID)
+			return nil
+		})
+		if !withinBudget {
+			r.deferForBudget(ctx, t.ID)
+			return
+		}
+
+		// TaskRestartDelay already applies any jitter called for by the
+		// policy, so the returned delay is used as-is.
+		delay, _, err := r.restarts.TaskRestartDelay(ctx, t)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to compute restart delay")
+			delay = 0
+		}
+		if delay == 0 {
+			err := r.store.Update(func(tx store.Tx) error {
+				return r.restarts.StartNow(tx, t.ID)
+			})
+			if err != nil {
+				log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("failed to start task")
+			}
+			return
+		}
+		r.restarts.DelayStart(ctx, t.ID, delay)
+		return
+	}
+
+	if t.Status.State == api.TaskStateRunning {
+		if restart.IsUnhealthy(t) && restart.Policy(t).Condition == api.RestartOnUnhealthy {
+			// Fall through to trigger a shutdown + replacement below, same
+			// as for a task that has reached a terminal state. The agent
+			// is responsible for honoring Spec.Container.StopGracePeriod
+			// once DesiredState is set to Shutdown.
+		} else {
+			r.restarts.RecordRunning(t)
+			if err := r.store.Update(func(tx store.Tx) error {
+				return r.restarts.CloseBreakerIfOpen(tx, t.ServiceID, t.ID)
+			}); err != nil {
+				log.G(ctx).WithError(err).WithField("service.id", t.ServiceID).Error("failed to close circuit breaker")
+			}
+			return
+		}
+	} else if t.Status.State != api.TaskStateFailed && t.Status.State != api.TaskStateCompleted {
+		return
+	}
+	if t.DesiredState >= api.TaskStateShutdown {
+		// Already being torn down; only react once.
+		return
+	}
+
+	err := r.store.Update(func(tx store.Tx) error {
+		service := store.GetService(tx, t.ServiceID)
+		if service != nil {
+			service = r.effectiveService(service)
+		}
+		_, err := r.restarts.Restart(ctx, tx, r.cluster, service, *t)
+		return err
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("restart failed")
+	}
+}
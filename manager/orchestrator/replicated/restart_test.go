@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/docker/go-events"
 	"github.com/docker/swarmkit/api"
 	"github.com/docker/swarmkit/api/defaults"
 	"github.com/docker/swarmkit/manager/orchestrator/testutils"
@@ -11,6 +12,7 @@ import (
 	"github.com/docker/swarmkit/manager/state/store"
 	"github.com/docker/swarmkit/protobuf/ptypes"
 	gogotypes "github.com/gogo/protobuf/types"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -22,7 +24,7 @@ func TestOrchestratorRestartOnAny(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
@@ -127,7 +129,7 @@ func TestOrchestratorRestartOnFailure(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
@@ -251,7 +253,7 @@ func TestOrchestratorRestartOnNone(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
@@ -384,7 +386,7 @@ func TestOrchestratorRestartDelay(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
@@ -476,7 +478,7 @@ func TestOrchestratorRestartMaxAttempts(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
@@ -644,7 +646,7 @@ func TestOrchestratorRestartWindow(t *testing.T) {
 	assert.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
@@ -813,7 +815,7 @@ func TestOrchestratorBackoffValues(t *testing.T) {
 	require.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
@@ -911,8 +913,15 @@ func TestOrchestratorBackoffValues(t *testing.T) {
 
 	testutils.Expect(t, watch, state.EventCommit{})
 
-	delay2a := baseTime + factorTime
-	observedTask2a := testutils.WatchTaskUpdateDelay(t, watch, delay2a)
+	// The default BackoffPolicy.JitterMode (decorrelated jitter) no longer
+	// produces a single deterministic delay; bound-check instead. On the
+	// first attempt for an instance, the decorrelated-jitter recurrence
+	// picks a delay in [Base, Base*2] (the default Multiplier).
+	before := time.Now()
+	observedTask2a := testutils.WatchTaskUpdate(t, watch)
+	elapsed := time.Since(before)
+	assert.True(t, elapsed >= baseTime, "delay %v should be at least Base (%v)", elapsed, baseTime)
+	assert.True(t, elapsed < maxTime, "delay %v should be well under Max (%v)", elapsed, maxTime)
 	assert.Equal(t, observedTask2a.DesiredState, api.TaskStateRunning)
 	assert.Equal(t, observedTask2a.ServiceAnnotations.Name, "name1")
 }
@@ -925,7 +934,7 @@ func TestOrchestratorTaskRestartDelay(t *testing.T) {
 	require.NotNil(t, s)
 	defer s.Close()
 
-	orchestrator := NewReplicatedOrchestrator(s)
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
 	defer orchestrator.Stop()
 
 	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
@@ -991,11 +1000,14 @@ func TestOrchestratorTaskRestartDelay(t *testing.T) {
 	delay, randomize, err := restartSV1.TaskRestartDelay(ctx, observedTask1)
 	require.NoError(t, err)
 
-	// Check that the delay duration is between 0 and the calculated backoff duration
-	assert.Equal(t, delay, baseTime+factorTime)
+	// With the default JitterMode (decorrelated jitter), TaskRestartDelay
+	// returns an already-jittered delay bounded by [Base, Max] rather than
+	// a fixed Base+Factor value.
+	assert.True(t, delay >= baseTime, "delay %v should be at least Base (%v)", delay, baseTime)
+	assert.True(t, delay <= maxTime, "delay %v should be at most Max (%v)", delay, maxTime)
 
-	// We should randomize the delay
-	assert.True(t, randomize)
+	// The delay is already jittered; callers should not randomize further.
+	assert.False(t, randomize)
 
 	// Update the service to use the original restart delay
 	err = s.Update(func(tx store.Tx) error {
@@ -1022,3 +1034,1106 @@ func TestOrchestratorTaskRestartDelay(t *testing.T) {
 	assert.False(t, randomize)
 	assert.Equal(t, delay, originalDelay)
 }
+
+// TestOrchestratorTaskRestartDelayLabelOverride verifies that
+// com.docker.swarm.restart.backoff.* labels on a task's Spec.Annotations
+// override the corresponding BackoffPolicy fields for that task alone,
+// without touching the ServiceSpec the task was created from.
+func TestOrchestratorTaskRestartDelayLabelOverride(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	restartSV := orchestrator.restarts
+
+	const overrideBase = 500 * time.Millisecond
+	const overrideMax = 2 * time.Second
+
+	task := &api.Task{
+		ID:        "task1",
+		ServiceID: "svc1",
+		Slot:      1,
+		Spec: api.TaskSpec{
+			Annotations: api.Annotations{
+				Labels: map[string]string{
+					"com.docker.swarm.restart.backoff.base":   overrideBase.String(),
+					"com.docker.swarm.restart.backoff.max":    overrideMax.String(),
+					"com.docker.swarm.restart.backoff.jitter": "none",
+				},
+			},
+			Restart: &api.RestartPolicy{
+				Backoff: &api.BackoffPolicy{
+					Base:   gogotypes.DurationProto(10 * time.Millisecond),
+					Factor: gogotypes.DurationProto(0),
+					Max:    gogotypes.DurationProto(time.Second),
+				},
+			},
+		},
+	}
+
+	// JitterMode none with Factor 0 and no Multiplier yields a flat
+	// Base+Factor delay, so this pins the delay to exactly the
+	// label-overridden Base rather than the spec's.
+	delay, randomize, err := restartSV.TaskRestartDelay(ctx, task)
+	require.NoError(t, err)
+	assert.False(t, randomize)
+	assert.Equal(t, overrideBase, delay)
+
+	// A malformed override is ignored, falling back to the spec's value.
+	task.Spec.Annotations.Labels["com.docker.swarm.restart.backoff.base"] = "not-a-duration"
+	delay, _, err = restartSV.TaskRestartDelay(ctx, task)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Millisecond, delay)
+}
+
+// TestOrchestratorDecorrelatedJitter exercises RestartSupervisor's
+// decorrelated-jitter recurrence directly: successive calls for the same
+// task instance stay within Max, and once the instance is recorded as
+// Running the next delay is back in the first-attempt range [Base, Base*2].
+func TestOrchestratorDecorrelatedJitter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	restartSV := orchestrator.restarts
+
+	task := &api.Task{
+		ID:        "task1",
+		ServiceID: "svc1",
+		Slot:      1,
+		Spec: api.TaskSpec{
+			Restart: &api.RestartPolicy{
+				Backoff: &api.BackoffPolicy{
+					Base: gogotypes.DurationProto(10 * time.Millisecond),
+					Max:  gogotypes.DurationProto(time.Second),
+				},
+			},
+		},
+	}
+
+	var delays []time.Duration
+	for i := 0; i < 3; i++ {
+		delay, randomize, err := restartSV.TaskRestartDelay(ctx, task)
+		require.NoError(t, err)
+		assert.False(t, randomize)
+		assert.True(t, delay <= time.Second)
+		delays = append(delays, delay)
+	}
+
+	// Every call after the first samples from [Base, prevSleep*3], so an
+	// individual sample may land lower than the one before it; the loop
+	// above therefore only checks that each delay stays within Max.
+	restartSV.RecordRunning(task)
+
+	resetDelay, _, err := restartSV.TaskRestartDelay(ctx, task)
+	require.NoError(t, err)
+	assert.True(t, resetDelay <= 10*time.Millisecond*2, "delay after RecordRunning should reset to a first-attempt range, got %v", resetDelay)
+}
+
+// TestOrchestratorRestartBackoff fails a task three times in a row under a
+// geometric BackoffPolicy (Multiplier set, JitterMode none) and asserts that
+// the elapsed time between successive TaskStateReady->TaskStateRunning
+// transitions grows on each attempt. The policy's Window is long enough
+// that marking each replacement Running does not reset the restart count.
+func TestOrchestratorRestartBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue() /*api.EventCreateTask{}, api.EventUpdateTask{}*/)
+	defer cancel()
+
+	baseTime := 20 * time.Millisecond
+	maxTime := 4 * time.Second
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name1",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnAny,
+						Window:    gogotypes.DurationProto(time.Minute),
+						Backoff: &api.BackoffPolicy{
+							Base:       gogotypes.DurationProto(baseTime),
+							Max:        gogotypes.DurationProto(maxTime),
+							Multiplier: 2.0,
+							JitterMode: api.JitterModeNone,
+						},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 1,
+					},
+				},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+
+	var transitions []time.Time
+	for i := 0; i < 3; i++ {
+		updated := task.Copy()
+		updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+		err = s.Update(func(tx store.Tx) error {
+			require.NoError(t, store.UpdateTask(tx, updated))
+			return nil
+		})
+		require.NoError(t, err)
+
+		testutils.Expect(t, watch, state.EventCommit{})
+		testutils.Expect(t, watch, api.EventUpdateTask{})
+		testutils.Expect(t, watch, state.EventCommit{})
+		testutils.Expect(t, watch, api.EventUpdateTask{})
+
+		task = testutils.WatchTaskCreate(t, watch)
+		testutils.Expect(t, watch, state.EventCommit{})
+
+		running := testutils.WatchTaskUpdate(t, watch)
+		assert.Equal(t, api.TaskStateRunning, running.DesiredState)
+		transitions = append(transitions, time.Now())
+		testutils.Expect(t, watch, state.EventCommit{})
+
+		err = s.Update(func(tx store.Tx) error {
+			task2 := store.GetTask(tx, task.ID)
+			require.NotNil(t, task2)
+			task2.Status.State = api.TaskStateRunning
+			require.NoError(t, store.UpdateTask(tx, task2))
+			return nil
+		})
+		require.NoError(t, err)
+		testutils.Expect(t, watch, api.EventUpdateTask{})
+
+		task = running
+	}
+
+	require.Len(t, transitions, 3)
+	first := transitions[1].Sub(transitions[0])
+	second := transitions[2].Sub(transitions[1])
+	assert.True(t, second > first, "expected geometric growth between restart attempts, got %v then %v", first, second)
+}
+
+// TestOrchestratorRestartOnUnhealthy confirms that a running task marked
+// unhealthy is replaced when its restart policy is RestartOnUnhealthy, but
+// left alone when the policy is RestartOnFailure.
+func TestOrchestratorRestartOnUnhealthy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		unhealthy := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "unhealthy-svc"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnUnhealthy,
+						Delay:     gogotypes.DurationProto(0),
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, unhealthy))
+
+		onFailure := &api.Service{
+			ID: "id2",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "on-failure-svc"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnFailure,
+						Delay:     gogotypes.DurationProto(0),
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, onFailure))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	var taskUnhealthySvc, taskOnFailureSvc *api.Task
+	for i := 0; i < 2; i++ {
+		created := testutils.WatchTaskCreate(t, watch)
+		switch created.ServiceID {
+		case "id1":
+			taskUnhealthySvc = created
+		case "id2":
+			taskOnFailureSvc = created
+		}
+	}
+	require.NotNil(t, taskUnhealthySvc)
+	require.NotNil(t, taskOnFailureSvc)
+
+	markUnhealthy := func(task *api.Task) {
+		updated := task.Copy()
+		updated.Status = api.TaskStatus{
+			State:  api.TaskStateRunning,
+			Health: api.HealthUnhealthy,
+		}
+		err = s.Update(func(tx store.Tx) error {
+			require.NoError(t, store.UpdateTask(tx, updated))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Service id2 (RestartOnFailure) should not be touched when marked
+	// unhealthy: the only event is the update written above.
+	markUnhealthy(taskOnFailureSvc)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	select {
+	case <-watch:
+		t.Fatal("unexpected event for task restarted under RestartOnFailure policy on unhealthy status")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Service id1 (RestartOnUnhealthy) should be shut down and replaced.
+	markUnhealthy(taskUnhealthySvc)
+	testutils.Expect(t, watch, api.EventUpdateTask{}) // the update written above
+	testutils.Expect(t, watch, api.EventUpdateTask{}) // shutdown of the unhealthy task
+
+	replacement := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, "id1", replacement.ServiceID)
+	assert.Equal(t, api.TaskStateNew, replacement.Status.State)
+}
+
+func exitStatus(state api.TaskState, exitCode int32) api.TaskStatus {
+	return api.TaskStatus{
+		State:     state,
+		Timestamp: ptypes.MustTimestampProto(time.Now()),
+		RuntimeStatus: &api.TaskStatus_Container{
+			Container: &api.ContainerStatus{
+				ExitCode:    exitCode,
+				ExitCodeSet: true,
+			},
+		},
+	}
+}
+
+// TestOrchestratorRestartIgnoreExitCode confirms that exit 0 under
+// RestartOnAny with IgnoreExitCodes=[0] produces no replacement.
+func TestOrchestratorRestartIgnoreExitCode(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition:       api.RestartOnAny,
+						Delay:           gogotypes.DurationProto(0),
+						IgnoreExitCodes: []int32{0},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+
+	updated := task.Copy()
+	updated.Status = exitStatus(api.TaskStateCompleted, 0)
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+
+	select {
+	case <-watch:
+		t.Fatal("task with an ignored exit code should not have been replaced")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestOrchestratorRestartExitCodes confirms that exit 42 with
+// RestartExitCodes=[42,137] under RestartOnNone still produces a
+// replacement.
+func TestOrchestratorRestartExitCodes(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition:        api.RestartOnNone,
+						Delay:            gogotypes.DurationProto(0),
+						RestartExitCodes: []int32{42, 137},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+
+	updated := task.Copy()
+	updated.Status = exitStatus(api.TaskStateFailed, 42)
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+
+	replacement := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, api.TaskStateNew, replacement.Status.State)
+}
+
+// TestOrchestratorRestartExitCodesRestricts confirms that under
+// RESTART_ON_FAILURE, an exit code absent from a non-empty
+// RestartExitCodes is treated like RESTART_ON_NONE and produces no
+// replacement, even though RESTART_ON_FAILURE alone would restart it.
+func TestOrchestratorRestartExitCodesRestricts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition:        api.RestartOnFailure,
+						Delay:            gogotypes.DurationProto(0),
+						RestartExitCodes: []int32{42, 137},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+
+	updated := task.Copy()
+	updated.Status = exitStatus(api.TaskStateFailed, 7)
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+
+	select {
+	case <-watch:
+		t.Fatal("task with an exit code outside RestartExitCodes should not have been replaced")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestOrchestratorClusterDefaultRestartPolicy confirms that a service
+// created without a RestartPolicy inherits the cluster's
+// DefaultRestartPolicy, and that failed tasks get replaced accordingly.
+func TestOrchestratorClusterDefaultRestartPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		cluster := &api.Cluster{
+			ID: "cluster1",
+			Spec: api.ClusterSpec{
+				Annotations: api.Annotations{Name: "default"},
+				DefaultRestartPolicy: &api.RestartPolicy{
+					Condition: api.RestartOnFailure,
+					Delay:     gogotypes.DurationProto(0),
+				},
+			},
+		}
+		require.NoError(t, store.CreateCluster(tx, cluster))
+
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, api.RestartOnFailure, task.Spec.Restart.Condition)
+
+	updated := task.Copy()
+	updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+
+	replacement := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, api.TaskStateNew, replacement.Status.State)
+}
+
+// TestOrchestratorClusterDefaultRestartPolicyUpdate confirms that updating
+// the cluster-wide default while a service is running takes effect on the
+// next failure, without requiring a ForceUpdate bump.
+func TestOrchestratorClusterDefaultRestartPolicyUpdate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		cluster := &api.Cluster{
+			ID: "cluster1",
+			Spec: api.ClusterSpec{
+				Annotations: api.Annotations{Name: "default"},
+				DefaultRestartPolicy: &api.RestartPolicy{
+					Condition: api.RestartOnNone,
+				},
+			},
+		}
+		require.NoError(t, store.CreateCluster(tx, cluster))
+
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, api.RestartOnNone, task.Spec.Restart.Condition)
+
+	// Bump the cluster-wide default to RestartOnFailure. No ForceUpdate,
+	// no service update at all.
+	err = s.Update(func(tx store.Tx) error {
+		cluster := store.GetCluster(tx, "cluster1")
+		require.NotNil(t, cluster)
+		cluster.Spec.DefaultRestartPolicy = &api.RestartPolicy{
+			Condition: api.RestartOnFailure,
+			Delay:     gogotypes.DurationProto(0),
+		}
+		require.NoError(t, store.UpdateCluster(tx, cluster))
+		return nil
+	})
+	require.NoError(t, err)
+
+	updated := task.Copy()
+	updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+	testutils.Expect(t, watch, api.EventUpdateTask{})
+
+	replacement := testutils.WatchTaskCreate(t, watch)
+	assert.Equal(t, api.TaskStateNew, replacement.Status.State)
+	assert.Equal(t, api.RestartOnFailure, replacement.Spec.Restart.Condition)
+}
+
+// TestOrchestratorRestartBudget fails 10 tasks of a 10-replica service
+// within one second under MaxRestartsPerMinute=5 and asserts that only
+// five replacements progress to DesiredState=Running while the rest stay
+// at DesiredState=Ready until the window drains.
+func TestOrchestratorRestartBudget(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnAny,
+						Delay:     gogotypes.DurationProto(0),
+						RestartBudget: &api.RestartBudget{
+							MaxRestartsPerMinute: 5,
+						},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 10}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	var tasks []*api.Task
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, testutils.WatchTaskCreate(t, watch))
+	}
+
+	for _, task := range tasks {
+		updated := task.Copy()
+		updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+		err = s.Update(func(tx store.Tx) error {
+			require.NoError(t, store.UpdateTask(tx, updated))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Drain every event produced by the 10 failures and replacements
+	// (shutdowns, creates, and at most 5 progressions to Running) within a
+	// short window, then count how many replacements actually reached
+	// DesiredState=Running.
+	progressed := 0
+	deferred := 0
+	deadline := time.After(2 * time.Second)
+	replacements := make(map[string]*api.Task)
+drain:
+	for {
+		select {
+		case ev := <-watch:
+			switch v := ev.(type) {
+			case api.EventCreateTask:
+				if v.Task.Status.State == api.TaskStateNew && v.Task.DesiredState == api.TaskStateReady {
+					replacements[v.Task.ID] = v.Task
+				}
+			case api.EventUpdateTask:
+				if _, ok := replacements[v.Task.ID]; ok {
+					if v.Task.DesiredState == api.TaskStateRunning {
+						progressed++
+						delete(replacements, v.Task.ID)
+					} else if v.Task.Status.Message == "restart budget exceeded" {
+						deferred++
+					}
+				}
+			}
+		case <-deadline:
+			break drain
+		}
+	}
+
+	assert.Equal(t, 5, progressed, "expected exactly MaxRestartsPerMinute replacements to progress to Running")
+	assert.True(t, deferred > 0, "expected at least one replacement to be deferred with the budget-exceeded reason")
+}
+
+// TestOrchestratorRestartMinHealthyFraction runs a 4-replica service under
+// MinHealthyFraction=0.5 and asserts that a failed task's replacement only
+// progresses to Running while at least half the service's replicas remain
+// Running, and is deferred once that fraction drops below the threshold.
+func TestOrchestratorRestartMinHealthyFraction(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventUpdateTask{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnAny,
+						Delay:     gogotypes.DurationProto(0),
+						RestartBudget: &api.RestartBudget{
+							MinHealthyFraction: 0.5,
+						},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 4}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	var tasks []*api.Task
+	for i := 0; i < 4; i++ {
+		tasks = append(tasks, testutils.WatchTaskCreate(t, watch))
+	}
+
+	// Mark half the replicas Running, satisfying MinHealthyFraction exactly.
+	for _, task := range tasks[:2] {
+		running := task.Copy()
+		running.Status = api.TaskStatus{State: api.TaskStateRunning, Timestamp: ptypes.MustTimestampProto(time.Now())}
+		err = s.Update(func(tx store.Tx) error {
+			require.NoError(t, store.UpdateTask(tx, running))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	testutils.WatchTaskUpdate(t, watch)
+	testutils.WatchTaskUpdate(t, watch)
+
+	// Failing one of the never-started replicas doesn't change the healthy
+	// count (it wasn't Running), so its replacement should progress.
+	failed := tasks[2].Copy()
+	failed.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, failed))
+		return nil
+	})
+	require.NoError(t, err)
+
+	testutils.WatchTaskUpdate(t, watch) // the failure written above
+	testutils.WatchTaskUpdate(t, watch) // shutdown of the failed task
+	replacement := testutils.WatchTaskCreate(t, watch)
+	running := testutils.WatchTaskUpdate(t, watch)
+	assert.Equal(t, replacement.ID, running.ID)
+	assert.Equal(t, api.TaskStateRunning, running.DesiredState)
+
+	// Failing one of the two Running replicas drops the healthy fraction to
+	// 1/4, below the 0.5 threshold, so its replacement should be deferred.
+	failedRunning := tasks[0].Copy()
+	failedRunning.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, failedRunning))
+		return nil
+	})
+	require.NoError(t, err)
+
+	testutils.WatchTaskUpdate(t, watch) // the failure written above
+	testutils.WatchTaskUpdate(t, watch) // shutdown of the failed task
+	deferredReplacement := testutils.WatchTaskCreate(t, watch)
+	deferredUpdate := testutils.WatchTaskUpdate(t, watch)
+	assert.Equal(t, deferredReplacement.ID, deferredUpdate.ID)
+	assert.Equal(t, restartBudgetExceededMessage, deferredUpdate.Status.Message)
+	assert.NotEqual(t, api.TaskStateRunning, deferredUpdate.DesiredState)
+}
+
+func TestOrchestratorCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventCircuitBreakerOpen{})
+	defer cancel()
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnAny,
+						Delay:     gogotypes.DurationProto(0),
+						CircuitBreaker: &api.CircuitBreaker{
+							FailureThreshold: 2,
+							Window:           gogotypes.DurationProto(time.Minute),
+							CooldownPeriod:   gogotypes.DurationProto(time.Minute),
+							HalfOpenProbes:   1,
+						},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 1}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	task := testutils.WatchTaskCreate(t, watch)
+
+	// First failure: below FailureThreshold, so a replacement is created
+	// as usual.
+	updated := task.Copy()
+	updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+	replacement := testutils.WatchTaskCreate(t, watch)
+
+	// Second failure: meets FailureThreshold, tripping the breaker open
+	// before this replacement would otherwise have been created.
+	updated = replacement.Copy()
+	updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, updated))
+		return nil
+	})
+	require.NoError(t, err)
+
+	breakerOpened := false
+	deadline := time.After(2 * time.Second)
+drain:
+	for {
+		select {
+		case ev := <-watch:
+			switch v := ev.(type) {
+			case api.EventCreateTask:
+				t.Fatalf("unexpected replacement task created while circuit breaker should be open: %v", v.Task.ID)
+			case api.EventCircuitBreakerOpen:
+				assert.Equal(t, "id1", v.ServiceID)
+				breakerOpened = true
+			}
+		case <-deadline:
+			break drain
+		}
+	}
+
+	assert.True(t, breakerOpened, "expected the circuit breaker to open and publish EventCircuitBreakerOpen")
+
+	var service *api.Service
+	s.View(func(tx store.ReadTx) error {
+		service = store.GetService(tx, "id1")
+		return nil
+	})
+	require.NotNil(t, service.CircuitBreaker)
+	assert.Equal(t, api.CircuitOpen, service.CircuitBreaker.State)
+}
+
+// drainUntilCreateOrOpen reads events off watch until it sees either an
+// api.EventCreateTask, which it returns, or an api.EventCircuitBreakerOpen,
+// which fails the test; it also fails the test if neither shows up before
+// the deadline.
+func drainUntilCreateOrOpen(t *testing.T, watch chan events.Event) *api.Task {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-watch:
+			switch v := ev.(type) {
+			case api.EventCreateTask:
+				return v.Task.Copy()
+			case api.EventCircuitBreakerOpen:
+				t.Fatalf("unexpected circuit breaker open event: %v", v)
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for a replacement task to be created")
+		}
+	}
+}
+
+// drainUntilOpen reads events off watch until it sees an
+// api.EventCircuitBreakerOpen, failing the test if it isn't observed
+// before the deadline.
+func drainUntilOpen(t *testing.T, watch chan events.Event) {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-watch:
+			if v, ok := ev.(api.EventCircuitBreakerOpen); ok {
+				assert.Equal(t, "id1", v.ServiceID)
+				return
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for the circuit breaker to open")
+		}
+	}
+}
+
+// TestOrchestratorCircuitBreakerHalfOpen exercises the rest of the breaker's
+// state machine: admission of a Half-Open probe once CooldownPeriod
+// elapses, a failed probe re-opening the breaker with its cooldown
+// doubled, and a successful probe closing the breaker.
+func TestOrchestratorCircuitBreakerHalfOpen(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s, prometheus.NewRegistry())
+	defer orchestrator.Stop()
+
+	watch, cancel := state.Watch(s.WatchQueue(), api.EventCreateTask{}, api.EventCircuitBreakerOpen{})
+	defer cancel()
+
+	const cooldown = 50 * time.Millisecond
+
+	err := s.Update(func(tx store.Tx) error {
+		j1 := &api.Service{
+			ID: "id1",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{Name: "name1"},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{Container: &api.ContainerSpec{}},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnAny,
+						Delay:     gogotypes.DurationProto(0),
+						CircuitBreaker: &api.CircuitBreaker{
+							FailureThreshold: 1,
+							Window:           gogotypes.DurationProto(time.Minute),
+							CooldownPeriod:   gogotypes.DurationProto(cooldown),
+							HalfOpenProbes:   1,
+						},
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{Replicas: 3}},
+			},
+		}
+		require.NoError(t, store.CreateService(tx, j1))
+		return nil
+	})
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	taskA := testutils.WatchTaskCreate(t, watch)
+	taskB := testutils.WatchTaskCreate(t, watch)
+	taskC := testutils.WatchTaskCreate(t, watch)
+
+	failTask := func(task *api.Task) {
+		updated := task.Copy()
+		updated.Status = api.TaskStatus{State: api.TaskStateFailed, Timestamp: ptypes.MustTimestampProto(time.Now())}
+		err := s.Update(func(tx store.Tx) error {
+			require.NoError(t, store.UpdateTask(tx, updated))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// taskA failing meets FailureThreshold, tripping the breaker open
+	// before a replacement is created for it.
+	failTask(taskA)
+	drainUntilOpen(t, watch)
+
+	// Once CooldownPeriod elapses, taskB failing is admitted as a
+	// Half-Open probe instead of being suppressed like taskA's was.
+	time.Sleep(2 * cooldown)
+	failTask(taskB)
+	probe := drainUntilCreateOrOpen(t, watch)
+
+	// The probe itself failing re-opens the breaker, doubling the cooldown.
+	failTask(probe)
+	drainUntilOpen(t, watch)
+
+	var service *api.Service
+	s.View(func(tx store.ReadTx) error {
+		service = store.GetService(tx, "id1")
+		return nil
+	})
+	require.NotNil(t, service.CircuitBreaker)
+	assert.Equal(t, api.CircuitOpen, service.CircuitBreaker.State)
+	doubledCooldown, err := gogotypes.DurationFromProto(service.CircuitBreaker.CooldownPeriod)
+	require.NoError(t, err)
+	assert.Equal(t, 2*cooldown, doubledCooldown)
+
+	// After the doubled cooldown elapses, taskC failing is admitted as a
+	// fresh Half-Open probe.
+	time.Sleep(2 * doubledCooldown)
+	failTask(taskC)
+	probe2 := drainUntilCreateOrOpen(t, watch)
+
+	// This probe reaching Running closes the breaker.
+	running := probe2.Copy()
+	running.Status = api.TaskStatus{State: api.TaskStateRunning, Timestamp: ptypes.MustTimestampProto(time.Now())}
+	err = s.Update(func(tx store.Tx) error {
+		require.NoError(t, store.UpdateTask(tx, running))
+		return nil
+	})
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var service *api.Service
+		s.View(func(tx store.ReadTx) error {
+			service = store.GetService(tx, "id1")
+			return nil
+		})
+		if service.CircuitBreaker != nil && service.CircuitBreaker.State == api.CircuitClosed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the circuit breaker to close, last state: %v", service.CircuitBreaker)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package restart
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// restartDelayBuckets are log-scale histogram buckets spanning 10ms to
+// about 87 minutes (10ms*2^19), wide enough to cover the Base..Max range of any
+// reasonable BackoffPolicy as well as plain RestartPolicy.Delay values.
+var restartDelayBuckets = prometheus.ExponentialBuckets(0.010, 2, 20)
+
+// Metrics holds the Prometheus collectors the RestartSupervisor reports
+// restart/backoff activity through. A nil *Metrics is valid and makes every
+// method a no-op, so callers that don't care about metrics can omit them
+// entirely.
+type Metrics struct {
+	restartsTotal        *prometheus.CounterVec
+	restartDelay         prometheus.Histogram
+	failuresSinceSuccess *prometheus.GaugeVec
+	suppressedTotal      *prometheus.CounterVec
+}
+
+// NewMetrics creates a Metrics that registers its collectors on reg. A nil
+// reg registers on prometheus.DefaultRegisterer.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &Metrics{
+		restartsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "swarmkit",
+			Subsystem: "task",
+			Name:      "restarts_total",
+			Help:      "Total number of task restarts performed by the orchestrator, by service and triggering reason.",
+		}, []string{"service", "reason"}),
+
+		restartDelay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "swarmkit",
+			Subsystem: "task",
+			Name:      "restart_delay_seconds",
+			Help:      "Delay applied before starting a replacement task, as computed by TaskRestartDelay.",
+			Buckets:   restartDelayBuckets,
+		}),
+
+		failuresSinceSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "swarmkit",
+			Subsystem: "task",
+			Name:      "failures_since_success",
+			Help:      "Number of consecutive restarts a service's tasks have gone through since one last reached Running.",
+		}, []string{"service"}),
+
+		suppressedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "swarmkit",
+			Name:      "restart_suppressed_total",
+			Help:      "Total number of restarts suppressed by MaxAttempts or a CircuitBreaker, by reason.",
+		}, []string{"reason"}),
+	}
+
+	reg.MustRegister(m.restartsTotal, m.restartDelay, m.failuresSinceSuccess, m.suppressedTotal)
+	return m
+}
+
+func (m *Metrics) observeRestart(serviceID, reason string) {
+	if m == nil {
+		return
+	}
+	m.restartsTotal.WithLabelValues(serviceID, reason).Inc()
+}
+
+func (m *Metrics) observeRestartDelay(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.restartDelay.Observe(d.Seconds())
+}
+
+func (m *Metrics) setFailuresSinceSuccess(serviceID string, failures uint64) {
+	if m == nil {
+		return
+	}
+	m.failuresSinceSuccess.WithLabelValues(serviceID).Set(float64(failures))
+}
+
+func (m *Metrics) observeSuppressed(reason string) {
+	if m == nil {
+		return
+	}
+	m.suppressedTotal.WithLabelValues(reason).Inc()
+}
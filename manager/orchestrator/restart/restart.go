@@ -0,0 +1,949 @@
+package restart
+
+import (
+	"container/list"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/api/defaults"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/orchestrator"
+	"github.com/docker/swarmkit/manager/state/store"
+	gogotypes "github.com/gogo/protobuf/types"
+	"golang.org/x/net/context"
+)
+
+const defaultOldTaskTimeout = time.Minute
+
+// Label keys recognized on a task's Spec.Annotations.Labels to override its
+// effective BackoffPolicy for that task alone, without touching the
+// ServiceSpec. This lets an operator tune backoff for one misbehaving
+// service ad hoc (e.g. via `docker service update --label-add`).
+const (
+	labelBackoffBase   = "com.docker.swarm.restart.backoff.base"
+	labelBackoffFactor = "com.docker.swarm.restart.backoff.factor"
+	labelBackoffMax    = "com.docker.swarm.restart.backoff.max"
+	labelBackoffJitter = "com.docker.swarm.restart.backoff.jitter"
+)
+
+// maxCircuitBreakerCooldown bounds how long a CircuitBreaker's cooldown can
+// grow to after repeated Half-Open probe failures, so a persistently bad
+// service doesn't end up locked out indefinitely.
+const maxCircuitBreakerCooldown = time.Hour
+
+// instanceTuple identifies a particular instance of a service, so restart
+// history can be tracked independently per-slot (or per-node, for global
+// services).
+type instanceTuple struct {
+	instance  uint64
+	serviceID string
+	nodeID    string // used for global tasks, which have no slot
+}
+
+// restartedInstance records a single restart so that RestartPolicy.Window
+// can be enforced.
+type restartedInstance struct {
+	timestamp time.Time
+}
+
+// restartHistoryRecord tracks restarts for a single instance so that
+// RestartPolicy.MaxAttempts can be enforced and so that backoff delays can
+// grow across successive failures.
+type restartHistoryRecord struct {
+	// restartedInstances holds the restarts that occurred within the
+	// current Window.
+	restartedInstances *list.List
+}
+
+// failuresSinceSuccess returns the number of restarts still within the
+// policy Window, i.e. since the instance last reached TaskStateRunning for
+// at least Window.
+func (record *restartHistoryRecord) failuresSinceSuccess() uint64 {
+	return uint64(record.restartedInstances.Len())
+}
+
+// delayedStart tracks a task that is waiting out a restart delay, so the
+// wait can be cancelled if the task is no longer needed.
+type delayedStart struct {
+	cancel context.CancelFunc
+	doneCh chan struct{}
+}
+
+// RestartSupervisor initiates and manages restarts. It is responsible for
+// delaying restarts, maintaining the restart history for tasks, and
+// deciding whether a given restart policy allows another restart attempt.
+type RestartSupervisor struct {
+	mu sync.Mutex
+
+	store *store.MemoryStore
+
+	delays map[string]*delayedStart
+
+	history map[instanceTuple]*restartHistoryRecord
+
+	// prevSleep holds the last delay returned by decorrelatedJitterDelay
+	// for each task instance, used as the basis for the next attempt's
+	// jitter range.
+	prevSleep map[instanceTuple]time.Duration
+
+	// budgetEvents tracks, per service, the timestamps of restarts that
+	// have been allowed to progress to Running, so RestartBudget's
+	// MaxRestartsPerMinute can be enforced with a sliding window.
+	budgetEvents map[string]*list.List
+
+	// breakerFailures tracks, per service, the timestamps of task
+	// failures observed while a CircuitBreaker is configured, so
+	// FailureThreshold can be evaluated over the breaker's Window. Unlike
+	// the breaker's open/half-open/closed state, this sliding window is
+	// not persisted: losing it across a leader election only delays
+	// detection of a fresh failure storm rather than affecting
+	// correctness.
+	breakerFailures map[string]*list.List
+
+	// probeTasks tracks, per service, the IDs of replacement tasks that
+	// checkBreaker has admitted as Half-Open probes. CloseBreakerIfOpen
+	// consults this so that only one of those tasks reaching Running can
+	// close the breaker, not any other task of the service that happens
+	// to transition to Running while it's Open or Half-Open. It is
+	// cleared whenever the breaker (re)opens.
+	probeTasks map[string]map[string]struct{}
+
+	// TaskTimeout is the period after which a running task is considered
+	// old enough that it no longer counts toward the restart history of
+	// the instance it replaced.
+	TaskTimeout time.Duration
+
+	// runningConfirms tracks, per instance, the pending timer started by
+	// RecordRunning that clears the instance's restart history once it has
+	// spent at least the restart policy's Window in TaskStateRunning. It
+	// is stopped and removed if the instance fails again before the timer
+	// fires (see recordRestart), so a task that merely flaps through
+	// Running doesn't reset MaxAttempts/backoff/budget/breaker counting.
+	runningConfirms map[instanceTuple]*time.Timer
+
+	// metrics reports restart/backoff activity to Prometheus. It may be
+	// nil, in which case reporting is skipped.
+	metrics *Metrics
+}
+
+// NewRestartSupervisor creates a new RestartSupervisor backed by the given
+// store. metrics may be nil to skip Prometheus reporting.
+func NewRestartSupervisor(store *store.MemoryStore, metrics *Metrics) *RestartSupervisor {
+	return &RestartSupervisor{
+		store:           store,
+		delays:          make(map[string]*delayedStart),
+		history:         make(map[instanceTuple]*restartHistoryRecord),
+		prevSleep:       make(map[instanceTuple]time.Duration),
+		budgetEvents:    make(map[string]*list.List),
+		breakerFailures: make(map[string]*list.List),
+		probeTasks:      make(map[string]map[string]struct{}),
+		TaskTimeout:     defaultOldTaskTimeout,
+		runningConfirms: make(map[instanceTuple]*time.Timer),
+		metrics:         metrics,
+	}
+}
+
+// WithinRestartBudget reports whether serviceID may progress another
+// restart to TaskStateRunning right now under policy's RestartBudget. When
+// it returns true (and MaxRestartsPerMinute is set), the attempt is
+// recorded against the sliding window so subsequent calls see it. tx is
+// used to evaluate MinHealthyFraction against the service's current
+// running task count.
+func (r *RestartSupervisor) WithinRestartBudget(tx store.ReadTx, policy *api.RestartPolicy, serviceID string) bool {
+	if policy.RestartBudget == nil {
+		return true
+	}
+
+	if policy.RestartBudget.MinHealthyFraction > 0 && !withinMinHealthyFraction(tx, policy.RestartBudget.MinHealthyFraction, serviceID) {
+		return false
+	}
+
+	if policy.RestartBudget.MaxRestartsPerMinute == 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events, ok := r.budgetEvents[serviceID]
+	if !ok {
+		events = list.New()
+		r.budgetEvents[serviceID] = events
+	}
+
+	now := time.Now()
+	for events.Len() > 0 {
+		front := events.Front()
+		if now.Sub(front.Value.(time.Time)) <= time.Minute {
+			break
+		}
+		events.Remove(front)
+	}
+
+	if uint32(events.Len()) >= policy.RestartBudget.MaxRestartsPerMinute {
+		return false
+	}
+
+	events.PushBack(now)
+	return true
+}
+
+// withinMinHealthyFraction reports whether at least minHealthyFraction of
+// serviceID's desired replicas are currently Running. Services that aren't
+// replicated (no fixed replica count to measure a fraction against) are
+// always considered healthy enough.
+func withinMinHealthyFraction(tx store.ReadTx, minHealthyFraction float64, serviceID string) bool {
+	service := store.GetService(tx, serviceID)
+	if service == nil {
+		return true
+	}
+	replicated := service.Spec.GetReplicated()
+	if replicated == nil || replicated.Replicas == 0 {
+		return true
+	}
+
+	tasks, err := store.FindTasks(tx, store.ByServiceID(serviceID))
+	if err != nil {
+		return true
+	}
+
+	var running uint64
+	for _, t := range tasks {
+		if t.Status.State == api.TaskStateRunning {
+			running++
+		}
+	}
+
+	return float64(running)/float64(replicated.Replicas) >= minHealthyFraction
+}
+
+func tupleForTask(t *api.Task) instanceTuple {
+	return instanceTuple{
+		instance:  t.Slot,
+		serviceID: t.ServiceID,
+		nodeID:    t.NodeID,
+	}
+}
+
+// Policy returns the effective restart policy for t, falling back to the
+// built-in service default (defaults.Service.Task.Restart) when the task
+// spec does not set one. Cluster-wide defaults are not consulted here.
+func Policy(t *api.Task) *api.RestartPolicy {
+	return restartPolicy(t)
+}
+
+func restartPolicy(t *api.Task) *api.RestartPolicy {
+	if t.Spec.Restart != nil {
+		return t.Spec.Restart
+	}
+	return defaults.Service.Task.Restart
+}
+
+// GetFailuresSinceSuccess returns the number of times the slot that t
+// belongs to has failed and been restarted since it was last observed
+// running for longer than the restart Window.
+func (r *RestartSupervisor) GetFailuresSinceSuccess(t *api.Task) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.history[tupleForTask(t)]
+	if !ok {
+		return 0
+	}
+	return record.failuresSinceSuccess()
+}
+
+// recordRestart adds an entry to the restart history for the task's
+// instance, pruning entries that have fallen outside of the policy Window,
+// and returns the updated record.
+func (r *RestartSupervisor) recordRestart(t *api.Task, policy *api.RestartPolicy) *restartHistoryRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tuple := tupleForTask(t)
+
+	// This instance is failing again, so any pending RecordRunning clear
+	// from its last Running observation never reached Window and must not
+	// fire: the failure history it was about to wipe is exactly what this
+	// restart needs to be counted against.
+	if timer, ok := r.runningConfirms[tuple]; ok {
+		timer.Stop()
+		delete(r.runningConfirms, tuple)
+	}
+
+	record, ok := r.history[tuple]
+	if !ok {
+		record = &restartHistoryRecord{restartedInstances: list.New()}
+		r.history[tuple] = record
+	}
+
+	now := time.Now()
+	record.restartedInstances.PushBack(restartedInstance{timestamp: now})
+
+	if window, err := gogotypes.DurationFromProto(policy.Window); err == nil && window > 0 {
+		for record.restartedInstances.Len() > 0 {
+			front := record.restartedInstances.Front()
+			if now.Sub(front.Value.(restartedInstance).timestamp) <= window {
+				break
+			}
+			record.restartedInstances.Remove(front)
+		}
+	}
+
+	r.metrics.setFailuresSinceSuccess(t.ServiceID, record.failuresSinceSuccess())
+
+	return record
+}
+
+// RecordRunning should be called every time t is observed in
+// TaskStateRunning. If t's restart policy sets no Window, the restart
+// history for its instance is cleared immediately, as there is nothing to
+// wait out. Otherwise, the clear is deferred until t has spent a full
+// Window in TaskStateRunning: a timer is (re-)armed for Window from now,
+// and recordRestart cancels it if the instance fails again first. This
+// keeps a task that merely flaps through Running from silently resetting
+// MaxAttempts/backoff/budget/breaker counting before Window has actually
+// elapsed.
+func (r *RestartSupervisor) RecordRunning(t *api.Task) {
+	policy := restartPolicy(t)
+	window, err := gogotypes.DurationFromProto(policy.Window)
+	if err != nil || window <= 0 {
+		r.clearHistory(t)
+		return
+	}
+
+	tuple := tupleForTask(t)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if timer, ok := r.runningConfirms[tuple]; ok {
+		timer.Stop()
+	}
+	r.runningConfirms[tuple] = time.AfterFunc(window, func() {
+		r.mu.Lock()
+		delete(r.runningConfirms, tuple)
+		delete(r.history, tuple)
+		delete(r.prevSleep, tuple)
+		r.mu.Unlock()
+		r.metrics.setFailuresSinceSuccess(t.ServiceID, 0)
+	})
+}
+
+// clearHistory immediately resets t's instance's restart history.
+func (r *RestartSupervisor) clearHistory(t *api.Task) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tuple := tupleForTask(t)
+	if timer, ok := r.runningConfirms[tuple]; ok {
+		timer.Stop()
+		delete(r.runningConfirms, tuple)
+	}
+	delete(r.history, tuple)
+	delete(r.prevSleep, tuple)
+	r.metrics.setFailuresSinceSuccess(t.ServiceID, 0)
+}
+
+// conditionAllows returns true if the task's restart policy condition is
+// satisfied by the state that t is currently observed in. Exit-code rules
+// are evaluated first and take priority over Condition in both
+// directions: IgnoreExitCodes vetoes a restart that Condition would
+// otherwise allow, and RestartExitCodes forces one that Condition alone
+// would not (e.g. under RESTART_ON_NONE).
+func conditionAllows(policy *api.RestartPolicy, t *api.Task) bool {
+	if exitCode, ok := containerExitCode(t); ok {
+		for _, ignored := range policy.IgnoreExitCodes {
+			if exitCode == ignored {
+				return false
+			}
+		}
+		if len(policy.RestartExitCodes) > 0 {
+			for _, allowed := range policy.RestartExitCodes {
+				if exitCode == allowed {
+					return true
+				}
+			}
+			if policy.Condition == api.RestartOnFailure || policy.Condition == api.RestartOnAny {
+				// exitCode isn't in RestartExitCodes, so it's treated like
+				// RESTART_ON_NONE for this task.
+				return false
+			}
+		}
+	}
+
+	switch policy.Condition {
+	case api.RestartOnNone:
+		return false
+	case api.RestartOnFailure:
+		return t.Status.State == api.TaskStateFailed
+	case api.RestartOnAny:
+		return t.Status.State == api.TaskStateFailed || t.Status.State == api.TaskStateCompleted
+	case api.RestartOnUnhealthy:
+		return t.Status.Health == api.HealthUnhealthy
+	}
+	return false
+}
+
+func containerExitCode(t *api.Task) (int32, bool) {
+	container := t.Status.GetContainer()
+	if container == nil || !container.ExitCodeSet {
+		return 0, false
+	}
+	return container.ExitCode, true
+}
+
+// IsUnhealthy returns true if t is running but has been marked unhealthy by
+// its container healthcheck.
+func IsUnhealthy(t *api.Task) bool {
+	return t.Status.State == api.TaskStateRunning && t.Status.Health == api.HealthUnhealthy
+}
+
+// shouldRestart returns true if the given restart policy allows another
+// restart attempt, given the number of failures already observed since the
+// last success.
+func shouldRestart(ctx context.Context, policy *api.RestartPolicy, failuresSinceSuccess uint64) bool {
+	if policy.MaxAttempts == 0 {
+		return true
+	}
+	if failuresSinceSuccess < uint64(policy.MaxAttempts) {
+		return true
+	}
+
+	log.G(ctx).Debug("not restarting task because restart policy MaxAttempts limit has been reached")
+	return false
+}
+
+// geometricCeiling computes min(Max, Base*Multiplier^attempts), falling
+// back to a Multiplier of 2.0 when the policy doesn't set one.
+func geometricCeiling(base, max time.Duration, multiplier float64, attempts uint64) time.Duration {
+	if multiplier <= 0 {
+		multiplier = 2.0
+	}
+	d := float64(base)
+	for i := uint64(0); i < attempts; i++ {
+		d *= multiplier
+		if d >= float64(max) {
+			return max
+		}
+	}
+	delay := time.Duration(d)
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// deterministicDelay reproduces the original, non-jittered backoff used
+// when BackoffPolicy.JitterMode is explicitly JitterModeNone: geometric
+// growth when Multiplier is set, otherwise a flat Base+Factor delay kept
+// for backward compatibility with policies predating Multiplier.
+func deterministicDelay(bp *api.BackoffPolicy, base, max time.Duration, attempts uint64) (time.Duration, error) {
+	if bp.Multiplier > 0 {
+		return geometricCeiling(base, max, bp.Multiplier, attempts), nil
+	}
+
+	factor, err := gogotypes.DurationFromProto(bp.Factor)
+	if err != nil {
+		return 0, err
+	}
+	delay := base + factor
+	if delay > max {
+		delay = max
+	}
+	return delay, nil
+}
+
+// decorrelatedJitterDelay implements the AWS-style "decorrelated jitter"
+// recurrence: sleep = min(Max, random_between(Base, prevSleep*3)), where
+// prevSleep starts at min(Max, random_between(Base, Base*Multiplier)) on
+// the first attempt for a given task instance. prevSleep is stored per
+// instance tuple and reset once the instance is observed Running again.
+func (r *RestartSupervisor) decorrelatedJitterDelay(t *api.Task, bp *api.BackoffPolicy, base, max time.Duration) time.Duration {
+	tuple := tupleForTask(t)
+
+	r.mu.Lock()
+	prev, ok := r.prevSleep[tuple]
+	r.mu.Unlock()
+
+	var upper time.Duration
+	if !ok {
+		multiplier := bp.Multiplier
+		if multiplier <= 0 {
+			multiplier = 2.0
+		}
+		upper = time.Duration(float64(base) * multiplier)
+	} else {
+		upper = prev * 3
+	}
+	if upper > max {
+		upper = max
+	}
+	if upper < base {
+		upper = base
+	}
+
+	sleep := base
+	if upper > base {
+		sleep += time.Duration(rand.Int63n(int64(upper - base + 1)))
+	}
+	if sleep > max {
+		sleep = max
+	}
+
+	r.mu.Lock()
+	r.prevSleep[tuple] = sleep
+	r.mu.Unlock()
+
+	return sleep
+}
+
+// TaskRestartDelay returns the amount of time the supervisor should wait
+// before starting the given (replacement) task, along with a bool
+// indicating whether the caller should additionally randomize the
+// returned delay before using it. When a BackoffPolicy is set, the
+// returned delay is already jittered according to its JitterMode, and
+// callers should not apply further randomization of their own.
+func (r *RestartSupervisor) TaskRestartDelay(ctx context.Context, t *api.Task) (time.Duration, bool, error) {
+	delay, randomize, err := r.taskRestartDelay(ctx, t)
+	if err == nil {
+		r.metrics.observeRestartDelay(delay)
+	}
+	return delay, randomize, err
+}
+
+// backoffWithLabelOverrides returns bp with any com.docker.swarm.restart.
+// backoff.* labels applied on top of it, for a single task. bp may be nil,
+// in which case the built-in default BackoffPolicy
+// (defaults.Service.Task.Restart.Backoff) is used as the base to override,
+// falling back to a zero-value BackoffPolicy if there is no default either. If labels contains none of the recognized keys, bp is
+// returned unchanged (including a nil bp). Malformed duration/jitter-mode
+// values are ignored and logged rather than rejecting the whole override,
+// since the surrounding RestartPolicy must still be usable. Parsed
+// durations are validated against defaults.Service.Task.Restart.Backoff.Max
+// so a mistyped label can't push a task's backoff past the sane ceiling the
+// rest of the cluster operates under.
+func backoffWithLabelOverrides(ctx context.Context, bp *api.BackoffPolicy, labels map[string]string) *api.BackoffPolicy {
+	if labels[labelBackoffBase] == "" && labels[labelBackoffFactor] == "" &&
+		labels[labelBackoffMax] == "" && labels[labelBackoffJitter] == "" {
+		return bp
+	}
+
+	ceiling := time.Duration(0)
+	if defBackoff := defaults.Service.Task.Restart.Backoff; defBackoff != nil {
+		if d, err := gogotypes.DurationFromProto(defBackoff.Max); err == nil {
+			ceiling = d
+		}
+	}
+
+	if bp == nil {
+		if defaults.Service.Task.Restart.Backoff != nil {
+			bp = defaults.Service.Task.Restart.Backoff.Copy()
+		} else {
+			bp = &api.BackoffPolicy{}
+		}
+	} else {
+		bp = bp.Copy()
+	}
+
+	parseLabelDuration := func(key string) (time.Duration, bool) {
+		raw, ok := labels[key]
+		if !ok {
+			return 0, false
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 || (ceiling > 0 && d > ceiling) {
+			log.G(ctx).WithField("label", key).WithField("value", raw).Warn("ignoring malformed restart backoff override label")
+			return 0, false
+		}
+		return d, true
+	}
+
+	if d, ok := parseLabelDuration(labelBackoffBase); ok {
+		bp.Base = gogotypes.DurationProto(d)
+	}
+	if d, ok := parseLabelDuration(labelBackoffFactor); ok {
+		bp.Factor = gogotypes.DurationProto(d)
+	}
+	if d, ok := parseLabelDuration(labelBackoffMax); ok {
+		bp.Max = gogotypes.DurationProto(d)
+	}
+	if raw, ok := labels[labelBackoffJitter]; ok {
+		switch strings.ToLower(raw) {
+		case "decorrelated":
+			bp.JitterMode = api.JitterModeDecorrelated
+		case "none":
+			bp.JitterMode = api.JitterModeNone
+		case "full":
+			bp.JitterMode = api.JitterModeFull
+		default:
+			log.G(ctx).WithField("label", labelBackoffJitter).WithField("value", raw).Warn("ignoring malformed restart backoff override label")
+		}
+	}
+
+	return bp
+}
+
+func (r *RestartSupervisor) taskRestartDelay(ctx context.Context, t *api.Task) (time.Duration, bool, error) {
+	policy := restartPolicy(t)
+	backoff := backoffWithLabelOverrides(ctx, policy.Backoff, t.Spec.Annotations.Labels)
+
+	if backoff == nil {
+		delay, err := gogotypes.DurationFromProto(policy.Delay)
+		if err != nil {
+			return 0, false, err
+		}
+		return delay, false, nil
+	}
+
+	base, err := gogotypes.DurationFromProto(backoff.Base)
+	if err != nil {
+		return 0, false, err
+	}
+	max, err := gogotypes.DurationFromProto(backoff.Max)
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch backoff.JitterMode {
+	case api.JitterModeNone:
+		delay, err := deterministicDelay(backoff, base, max, r.GetFailuresSinceSuccess(t))
+		if err != nil {
+			return 0, false, err
+		}
+		return delay, false, nil
+
+	case api.JitterModeFull:
+		ceiling := geometricCeiling(base, max, backoff.Multiplier, r.GetFailuresSinceSuccess(t))
+		if ceiling <= 0 {
+			return 0, false, nil
+		}
+		return time.Duration(rand.Int63n(int64(ceiling) + 1)), false, nil
+
+	default:
+		// JitterModeDecorrelated, the zero value. Policies created before
+		// JitterMode existed (including those that only set the legacy
+		// Jitter bool) land here and get decorrelated jitter by default.
+		return r.decorrelatedJitterDelay(t, backoff, base, max), false, nil
+	}
+}
+
+// recordBreakerFailure records a task failure against serviceID's breaker
+// failure window and, if the breaker is Closed and FailureThreshold has
+// been met within Window, trips it Open. If the breaker was Half-Open, any
+// failure is treated as a failed probe: the breaker re-opens immediately
+// with its CooldownPeriod doubled (capped at maxCircuitBreakerCooldown),
+// without waiting for FailureThreshold again.
+func (r *RestartSupervisor) recordBreakerFailure(ctx context.Context, tx store.Tx, cb *api.CircuitBreaker, service *api.Service) {
+	if service.CircuitBreaker != nil && service.CircuitBreaker.State == api.CircuitHalfOpen {
+		cooldown, err := gogotypes.DurationFromProto(service.CircuitBreaker.CooldownPeriod)
+		if err != nil || cooldown <= 0 {
+			cooldown, err = gogotypes.DurationFromProto(cb.CooldownPeriod)
+			if err != nil {
+				cooldown = 0
+			}
+		}
+		cooldown *= 2
+		if cooldown > maxCircuitBreakerCooldown {
+			cooldown = maxCircuitBreakerCooldown
+		}
+		r.openBreaker(ctx, tx, service, cooldown)
+		return
+	}
+
+	if service.CircuitBreaker != nil && service.CircuitBreaker.State == api.CircuitOpen {
+		return
+	}
+
+	r.mu.Lock()
+	events, ok := r.breakerFailures[service.ID]
+	if !ok {
+		events = list.New()
+		r.breakerFailures[service.ID] = events
+	}
+	now := time.Now()
+	events.PushBack(now)
+	if window, err := gogotypes.DurationFromProto(cb.Window); err == nil && window > 0 {
+		for events.Len() > 0 {
+			front := events.Front()
+			if now.Sub(front.Value.(time.Time)) <= window {
+				break
+			}
+			events.Remove(front)
+		}
+	}
+	count := events.Len()
+	r.mu.Unlock()
+
+	if uint32(count) < cb.FailureThreshold {
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.breakerFailures, service.ID)
+	r.mu.Unlock()
+
+	cooldown, err := gogotypes.DurationFromProto(cb.CooldownPeriod)
+	if err != nil {
+		cooldown = 0
+	}
+	r.openBreaker(ctx, tx, service, cooldown)
+}
+
+// openBreaker transitions service's breaker to Open with the given
+// cooldown, persists it, discards any probe tasks admitted during a prior
+// Half-Open window, and publishes an api.EventCircuitBreakerOpen.
+func (r *RestartSupervisor) openBreaker(ctx context.Context, tx store.Tx, service *api.Service, cooldown time.Duration) {
+	openedAt, err := gogotypes.TimestampProto(time.Now())
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to encode circuit breaker open timestamp")
+	}
+	service.CircuitBreaker = &api.CircuitBreakerState{
+		State:          api.CircuitOpen,
+		OpenedAt:       openedAt,
+		CooldownPeriod: gogotypes.DurationProto(cooldown),
+	}
+	if err := store.UpdateService(tx, service); err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", service.ID).Error("failed to persist circuit breaker state")
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.probeTasks, service.ID)
+	r.mu.Unlock()
+
+	r.store.WatchQueue().Publish(api.EventCircuitBreakerOpen{ServiceID: service.ID})
+}
+
+// checkBreaker reports whether service's breaker currently allows
+// taskID, the replacement task about to be created for a failed
+// instance, to proceed. A Closed breaker always allows it. An Open
+// breaker allows it only once CooldownPeriod has elapsed, at which point
+// it transitions to Half-Open and this call admits taskID as its first
+// probe. A Half-Open breaker allows it as long as RemainingProbes is
+// non-zero, decrementing it and admitting taskID as a probe on each
+// call. Admitted probe IDs are recorded so a later CloseBreakerIfOpen
+// can verify the task reaching Running is actually one of them.
+func (r *RestartSupervisor) checkBreaker(ctx context.Context, tx store.Tx, cb *api.CircuitBreaker, service *api.Service, taskID string) bool {
+	state := service.CircuitBreaker
+	if state == nil || state.State == api.CircuitClosed {
+		return true
+	}
+
+	if state.State == api.CircuitOpen {
+		openedAt, err := gogotypes.TimestampFromProto(state.OpenedAt)
+		if err != nil {
+			openedAt = time.Now()
+		}
+		cooldown, err := gogotypes.DurationFromProto(state.CooldownPeriod)
+		if err != nil || cooldown <= 0 {
+			cooldown, err = gogotypes.DurationFromProto(cb.CooldownPeriod)
+			if err != nil {
+				cooldown = 0
+			}
+		}
+		if time.Since(openedAt) < cooldown {
+			return false
+		}
+
+		state = &api.CircuitBreakerState{
+			State:           api.CircuitHalfOpen,
+			CooldownPeriod:  gogotypes.DurationProto(cooldown),
+			RemainingProbes: cb.HalfOpenProbes,
+		}
+	}
+
+	if state.RemainingProbes == 0 {
+		return false
+	}
+	state.RemainingProbes--
+	service.CircuitBreaker = state
+	if err := store.UpdateService(tx, service); err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", service.ID).Error("failed to persist circuit breaker state")
+		return false
+	}
+
+	r.mu.Lock()
+	probes, ok := r.probeTasks[service.ID]
+	if !ok {
+		probes = make(map[string]struct{})
+		r.probeTasks[service.ID] = probes
+	}
+	probes[taskID] = struct{}{}
+	r.mu.Unlock()
+
+	return true
+}
+
+// CloseBreakerIfOpen closes serviceID's circuit breaker once taskID, one
+// of its Half-Open probe tasks admitted by checkBreaker, has reached
+// TaskStateRunning, so normal restart behavior resumes. It is a no-op if
+// the breaker isn't Half-Open, or if taskID isn't one of the probes
+// checkBreaker admitted, so ordinary tasks of the service reaching
+// Running while the breaker is Open or Half-Open can't close it early.
+func (r *RestartSupervisor) CloseBreakerIfOpen(tx store.Tx, serviceID, taskID string) error {
+	service := store.GetService(tx, serviceID)
+	if service == nil || service.CircuitBreaker == nil || service.CircuitBreaker.State != api.CircuitHalfOpen {
+		return nil
+	}
+
+	r.mu.Lock()
+	_, admitted := r.probeTasks[serviceID][taskID]
+	if admitted {
+		delete(r.probeTasks, serviceID)
+	}
+	r.mu.Unlock()
+	if !admitted {
+		return nil
+	}
+
+	service.CircuitBreaker = &api.CircuitBreakerState{State: api.CircuitClosed}
+	return store.UpdateService(tx, service)
+}
+
+// Restart transitions the failed task t to TaskStateShutdown and, if the
+// restart policy allows it, creates a replacement task in the same
+// transaction. The caller is responsible for starting the replacement
+// (immediately or after StartNow/DelayStart) once the transaction commits.
+// The restart policy is read from service's spec when it sets one, rather
+// than from t's own spec, so a policy changed after t was created (e.g. a
+// cluster-wide default the caller merged into service) applies to t's
+// failure.
+func (r *RestartSupervisor) Restart(ctx context.Context, tx store.Tx, cluster *api.Cluster, service *api.Service, t api.Task) (*api.Task, error) {
+	t.DesiredState = api.TaskStateShutdown
+	if err := store.UpdateTask(tx, &t); err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("failed to set task desired state to shutdown")
+		return nil, err
+	}
+
+	if service == nil {
+		return nil, nil
+	}
+
+	policy := restartPolicy(&t)
+	if service.Spec.Task.Restart != nil {
+		policy = service.Spec.Task.Restart
+	}
+	record := r.recordRestart(&t, policy)
+
+	if !conditionAllows(policy, &t) {
+		return nil, nil
+	}
+	if !shouldRestart(ctx, policy, record.failuresSinceSuccess()-1) {
+		r.metrics.observeSuppressed("max_attempts")
+		return nil, nil
+	}
+
+	restartTask := orchestrator.NewTask(cluster, service, t.Slot, t.NodeID)
+	restartTask.DesiredState = api.TaskStateReady
+
+	if policy.CircuitBreaker != nil {
+		r.recordBreakerFailure(ctx, tx, policy.CircuitBreaker, service)
+		if !r.checkBreaker(ctx, tx, policy.CircuitBreaker, service, restartTask.ID) {
+			r.metrics.observeSuppressed("circuit_breaker")
+			return nil, nil
+		}
+	}
+
+	if err := store.CreateTask(tx, restartTask); err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", restartTask.ID).Error("task create failed")
+		return nil, err
+	}
+
+	r.metrics.observeRestart(service.ID, restartReason(&t))
+
+	return restartTask, nil
+}
+
+// restartReason describes why t is being restarted, for the
+// swarmkit_task_restarts_total reason label.
+func restartReason(t *api.Task) string {
+	switch {
+	case IsUnhealthy(t):
+		return "unhealthy"
+	case t.Status.State == api.TaskStateCompleted:
+		return "completed"
+	default:
+		return "failed"
+	}
+}
+
+// StartNow immediately sets t's desired state to TaskStateRunning.
+func (r *RestartSupervisor) StartNow(tx store.Tx, taskID string) error {
+	t := store.GetTask(tx, taskID)
+	if t == nil {
+		return nil
+	}
+	t.DesiredState = api.TaskStateRunning
+	return store.UpdateTask(tx, t)
+}
+
+// DelayStart starts a timer that calls StartNow for taskID once delay has
+// elapsed. The returned channel is closed once the attempt to start the
+// task has been made. Any previously pending delay for the same task is
+// cancelled.
+func (r *RestartSupervisor) DelayStart(ctx context.Context, taskID string, delay time.Duration) <-chan struct{} {
+	r.mu.Lock()
+	if old, ok := r.delays[taskID]; ok {
+		old.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	doneCh := make(chan struct{})
+	r.delays[taskID] = &delayedStart{cancel: cancel, doneCh: doneCh}
+	r.mu.Unlock()
+
+	go func() {
+		defer close(doneCh)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		r.mu.Lock()
+		delete(r.delays, taskID)
+		r.mu.Unlock()
+
+		err := r.store.Update(func(tx store.Tx) error {
+			return r.StartNow(tx, taskID)
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("task.id", taskID).Error("failed to start task after restart delay")
+		}
+	}()
+
+	return doneCh
+}
+
+// Cancel aborts a pending delayed restart for the given task ID, if any.
+func (r *RestartSupervisor) Cancel(taskID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delay, ok := r.delays[taskID]
+	if !ok {
+		return
+	}
+	delay.cancel()
+	delete(r.delays, taskID)
+}
+
+// CancelAll aborts every pending delayed restart and RecordRunning clear
+// tracked by the supervisor.
+func (r *RestartSupervisor) CancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for taskID, delay := range r.delays {
+		delay.cancel()
+		delete(r.delays, taskID)
+	}
+	for tuple, timer := range r.runningConfirms {
+		timer.Stop()
+		delete(r.runningConfirms, tuple)
+	}
+}